@@ -0,0 +1,75 @@
+package trap
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrorHandler receives every error trap encounters while running
+// callbacks: a panicking signal or kill callback (stack is non-nil in that
+// case), a callback that misses its deadline, an error returned by a reload
+// callback run on a reload signal, or internal bookkeeping errors. A panic
+// in a reload callback is not recovered and never reaches the handler. The
+// default handler prints to stdout; install your own with SetErrorHandler
+// to route these through your application's logger instead.
+type ErrorHandler func(sig os.Signal, err error, stack []byte)
+
+// MultiError aggregates the errors collected since the last time they were
+// read, as returned by Deferrer.
+type MultiError struct {
+	Errors []error
+}
+
+func (m *MultiError) Error() string {
+	if m == nil || len(m.Errors) == 0 {
+		return "trap: no errors"
+	}
+
+	parts := make([]string, len(m.Errors))
+
+	for i, err := range m.Errors {
+		parts[i] = err.Error()
+	}
+
+	return strings.Join(parts, "; ")
+}
+
+// defaultErrorHandler is installed on every new Trap and simply prints to
+// stdout, matching the package's original behaviour.
+func defaultErrorHandler(sig os.Signal, err error, stack []byte) {
+	if len(stack) > 0 {
+		fmt.Printf("trap error (signal: %v): %s\n%s", sig, err, stack)
+
+		return
+	}
+
+	fmt.Printf("trap error (signal: %v): %s\n", sig, err)
+}
+
+// SetErrorHandler installs fn as the handler for every error trap
+// encounters while running callbacks. Passing nil restores the default,
+// stdout-printing handler.
+func (t *Trap) SetErrorHandler(fn ErrorHandler) {
+	t.errMux.Lock()
+	defer t.errMux.Unlock()
+
+	if fn == nil {
+		fn = defaultErrorHandler
+	}
+
+	t.errorHandler = fn
+}
+
+// handleError records err for later retrieval through Deferrer's
+// MultiError, and invokes the currently installed ErrorHandler.
+func (t *Trap) handleError(sig os.Signal, err error, stack []byte) {
+	t.errMux.Lock()
+	handler := t.errorHandler
+	t.pendingErrors = append(t.pendingErrors, err)
+	t.errMux.Unlock()
+
+	handler(sig, err, stack)
+}
+
+func SetErrorHandler(fn ErrorHandler) { Default.SetErrorHandler(fn) }
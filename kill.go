@@ -0,0 +1,213 @@
+package trap
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Phase constants double as priorities for OnKillWithPriority: lower values
+// run first. Network listeners and other "stop accepting new work" callbacks
+// belong in PhasePreStop, in-flight work draining in PhaseStop, and things
+// like flushing logs or metrics in PhasePostStop.
+const (
+	PhasePreStop  = -100
+	PhaseStop     = 0
+	PhasePostStop = 100
+)
+
+// isKillSignal reports whether s is one of the signals that triggers the
+// kill callback phases: SIGKILL, SIGINT, SIGQUIT or SIGTERM.
+func isKillSignal(s os.Signal) bool {
+	switch s {
+	case syscall.SIGKILL, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM:
+		return true
+	default:
+		return false
+	}
+}
+
+// EnableForceExitOnSecondSignal arms a second-signal escape hatch: once the
+// kill callback phases have started running for a first SIGKILL, SIGINT,
+// SIGQUIT or SIGTERM, a subsequent one of those signals bypasses the
+// callback list entirely and calls os.Exit(exitCode). This is the same
+// pattern nginx, kubelet and docker use for an operator who doesn't want to
+// wait out a stuck shutdown.
+func (t *Trap) EnableForceExitOnSecondSignal(exitCode int) {
+	t.shutdownMux.Lock()
+	defer t.shutdownMux.Unlock()
+
+	t.forceExitEnabled = true
+	t.forceExitCode = exitCode
+}
+
+// handleKillSignal is called by the listener goroutine for every kill
+// signal. The first one starts the kill callback phases on their own
+// goroutine, tracked by killWait, so the listener keeps draining the signal
+// channel instead of blocking for the duration of the shutdown; any further
+// one force-exits if EnableForceExitOnSecondSignal was called. killWait is
+// what lets Deferrer/Stop wait for that goroutine to actually finish instead
+// of just the listener loop.
+func (t *Trap) handleKillSignal(s os.Signal) {
+	t.shutdownMux.Lock()
+	alreadyShuttingDown := t.shuttingDown
+	t.shuttingDown = true
+	forceExit := t.forceExitEnabled
+	exitCode := t.forceExitCode
+	t.shutdownMux.Unlock()
+
+	if alreadyShuttingDown && forceExit {
+		t.handleError(s, fmt.Errorf("second %v received, forcing exit", s), nil)
+
+		os.Exit(exitCode)
+
+		return
+	}
+
+	t.killWait.Add(1)
+
+	go func() {
+		defer t.killWait.Done()
+
+		t.processSignal(s)
+	}()
+}
+
+// OnKill will process the callback on receiving a SIGKILL, SIGQUIT, SIGINT
+// or SIGTERM signal (see isKillSignal).
+// A normal, or panic termination will result in a SIGINT, therefor triggering these callbacks
+// It runs at PhaseStop; use OnKillWithPriority to run before or after other callbacks.
+func (t *Trap) OnKill(cb Callback) CallbackRemover {
+	return t.OnKillWithPriority(PhaseStop, cb)
+}
+
+// OnKillContext behaves like OnKill, but cb receives a context.Context
+// derived from ctx that is cancelled once the global shutdown timeout (see
+// SetShutdownTimeout) elapses, giving the callback a standard way to bound
+// its own work (e.g. passing it straight into http.Server.Shutdown).
+func (t *Trap) OnKillContext(ctx context.Context, cb ContextCallback) CallbackRemover {
+	return t.registerKill(PhaseStop, callbackEntry{
+		run:  cb,
+		base: ctx,
+	})
+}
+
+// OnKillWithPriority behaves like OnKill, but lets the caller pick the phase
+// a callback runs in. Callbacks registered with a lower priority run, and
+// fully complete (or are abandoned once the shutdown timeout set through
+// SetShutdownTimeout elapses), before callbacks with a higher priority; callbacks that
+// share a priority run concurrently with each other. PhasePreStop,
+// PhaseStop and PhasePostStop cover the common cases, but any int works.
+func (t *Trap) OnKillWithPriority(priority int, cb Callback) CallbackRemover {
+	return t.registerKill(priority, callbackEntry{
+		run: func(ctx context.Context) { cb() },
+	})
+}
+
+// registerKill stores entry in the bucket for priority.
+func (t *Trap) registerKill(priority int, entry callbackEntry) CallbackRemover {
+	t.killMux.Lock()
+	defer t.killMux.Unlock()
+
+	l, ok := t.killBuckets[priority]
+
+	if !ok {
+		l = list.New()
+
+		t.killBuckets[priority] = l
+	}
+
+	e := l.PushBack(entry)
+
+	return func() {
+		t.killMux.Lock()
+		defer t.killMux.Unlock()
+
+		l.Remove(e)
+	}
+}
+
+// runKillCallbacks runs every registered kill callback, phase by phase in
+// ascending priority order. Callbacks within a phase run concurrently and
+// are waited for, bounded by the global shutdown timeout, before the next
+// phase starts. The bucket set is truncated up front so a second SIGKILL,
+// SIGINT, SIGQUIT or SIGTERM can't trigger the same callbacks twice.
+func (t *Trap) runKillCallbacks(s os.Signal) {
+	t.killMux.Lock()
+	buckets := t.killBuckets
+	t.killBuckets = map[int]*list.List{}
+	t.killMux.Unlock()
+
+	priorities := make([]int, 0, len(buckets))
+
+	for p := range buckets {
+		priorities = append(priorities, p)
+	}
+
+	sort.Ints(priorities)
+
+	for _, p := range priorities {
+		t.runKillPhase(s, buckets[p])
+	}
+}
+
+// runKillPhase runs every callback in l concurrently and waits for them all
+// to finish, bounded by the global shutdown timeout.
+func (t *Trap) runKillPhase(s os.Signal, l *list.List) {
+	var wg sync.WaitGroup
+
+	for e := l.Front(); e != nil; e = e.Next() {
+		entry, ok := e.Value.(callbackEntry)
+
+		if !ok {
+			continue
+		}
+
+		wg.Add(1)
+
+		go func(entry callbackEntry) {
+			defer wg.Done()
+
+			t.runCallback(s, entry)
+		}(entry)
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		wg.Wait()
+	}()
+
+	timeout := t.getShutdownTimeout()
+
+	if timeout <= 0 {
+		<-done
+
+		return
+	}
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.handleError(s, fmt.Errorf("kill phase timed out after %s", timeout), nil)
+	}
+}
+
+func OnKill(cb Callback) CallbackRemover { return Default.OnKill(cb) }
+
+func OnKillContext(ctx context.Context, cb ContextCallback) CallbackRemover {
+	return Default.OnKillContext(ctx, cb)
+}
+
+func OnKillWithPriority(priority int, cb Callback) CallbackRemover {
+	return Default.OnKillWithPriority(priority, cb)
+}
+
+func EnableForceExitOnSecondSignal(exitCode int) { Default.EnableForceExitOnSecondSignal(exitCode) }
@@ -0,0 +1,181 @@
+package trap
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestDeferrerWaitsForKillCallbacks guards against the kill-dispatch
+// goroutine (see handleKillSignal) racing ahead of Deferrer: a slow OnKill
+// callback must have finished running by the time Deferrer returns.
+func TestDeferrerWaitsForKillCallbacks(t *testing.T) {
+	tr := New()
+
+	var ran int32
+
+	tr.OnKill(func() {
+		time.Sleep(100 * time.Millisecond)
+		atomic.StoreInt32(&ran, 1)
+	})
+
+	tr.Deferrer()
+
+	if atomic.LoadInt32(&ran) != 1 {
+		t.Fatal("Deferrer returned before its kill callback finished")
+	}
+}
+
+// TestShutdownTimeoutAbandonsSlowCallback verifies that a kill callback
+// exceeding SetShutdownTimeout is abandoned rather than blocking Deferrer,
+// and that the timeout is reported through the ErrorHandler.
+func TestShutdownTimeoutAbandonsSlowCallback(t *testing.T) {
+	tr := New()
+	tr.SetShutdownTimeout(20 * time.Millisecond)
+
+	var gotErr int32
+
+	tr.SetErrorHandler(func(sig os.Signal, err error, stack []byte) {
+		atomic.StoreInt32(&gotErr, 1)
+	})
+
+	tr.OnKill(func() {
+		time.Sleep(200 * time.Millisecond)
+	})
+
+	start := time.Now()
+	tr.Deferrer()
+	elapsed := time.Since(start)
+
+	if elapsed > 150*time.Millisecond {
+		t.Fatalf("Deferrer took %s, expected it to abandon the callback near the shutdown timeout", elapsed)
+	}
+
+	if atomic.LoadInt32(&gotErr) != 1 {
+		t.Fatal("expected the missed deadline to be reported through the error handler")
+	}
+}
+
+// TestPanicInKillCallbackIsRecovered verifies a panicking kill callback is
+// recovered and reported rather than taking down Deferrer (and the process).
+func TestPanicInKillCallbackIsRecovered(t *testing.T) {
+	tr := New()
+
+	var gotErr int32
+
+	tr.SetErrorHandler(func(sig os.Signal, err error, stack []byte) {
+		atomic.StoreInt32(&gotErr, 1)
+	})
+
+	tr.OnKill(func() {
+		panic("boom")
+	})
+
+	tr.Deferrer()
+
+	if atomic.LoadInt32(&gotErr) != 1 {
+		t.Fatal("expected the panic to be reported through the error handler")
+	}
+}
+
+// TestKillPhaseOrdering verifies the centerpiece guarantee of
+// OnKillWithPriority: PhasePreStop fully completes before PhaseStop starts,
+// which fully completes before PhasePostStop starts.
+func TestKillPhaseOrdering(t *testing.T) {
+	tr := New()
+
+	var mu sync.Mutex
+	var order []string
+	var preStopRunning, stopRunning int32
+
+	record := func(name string) {
+		mu.Lock()
+		order = append(order, name)
+		mu.Unlock()
+	}
+
+	tr.OnKillWithPriority(PhasePreStop, func() {
+		atomic.AddInt32(&preStopRunning, 1)
+		time.Sleep(30 * time.Millisecond)
+		record("pre-stop-a")
+		atomic.AddInt32(&preStopRunning, -1)
+	})
+	tr.OnKillWithPriority(PhasePreStop, func() {
+		record("pre-stop-b")
+	})
+	tr.OnKillWithPriority(PhaseStop, func() {
+		if atomic.LoadInt32(&preStopRunning) != 0 {
+			t.Error("PhaseStop callback started before PhasePreStop finished")
+		}
+
+		atomic.AddInt32(&stopRunning, 1)
+		time.Sleep(30 * time.Millisecond)
+		record("stop")
+		atomic.AddInt32(&stopRunning, -1)
+	})
+	tr.OnKillWithPriority(PhasePostStop, func() {
+		if atomic.LoadInt32(&stopRunning) != 0 {
+			t.Error("PhasePostStop callback started before PhaseStop finished")
+		}
+
+		record("post-stop")
+	})
+
+	tr.Deferrer()
+
+	if len(order) != 4 {
+		t.Fatalf("expected 4 recorded callbacks, got %d: %v", len(order), order)
+	}
+
+	index := make(map[string]int, len(order))
+
+	for i, name := range order {
+		index[name] = i
+	}
+
+	if index["pre-stop-a"] > index["stop"] || index["pre-stop-b"] > index["stop"] {
+		t.Fatalf("a pre-stop callback ran after the stop phase started: %v", order)
+	}
+
+	if index["stop"] > index["post-stop"] {
+		t.Fatalf("the stop phase ran after post-stop started: %v", order)
+	}
+}
+
+// TestKillPhaseRunsConcurrentlyWithinPhase verifies that callbacks sharing a
+// priority run concurrently with each other, rather than one after another.
+func TestKillPhaseRunsConcurrentlyWithinPhase(t *testing.T) {
+	tr := New()
+
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+
+	cb := func() {
+		started <- struct{}{}
+		<-release
+	}
+
+	tr.OnKillWithPriority(PhasePreStop, cb)
+	tr.OnKillWithPriority(PhasePreStop, cb)
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		tr.Deferrer()
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatal("pre-stop callbacks did not both start concurrently")
+		}
+	}
+
+	close(release)
+	<-done
+}
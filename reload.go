@@ -0,0 +1,125 @@
+package trap
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// ReloadCallback is a reload handler that can report failure, unlike the
+// fire-and-forget Callback used for shutdown. Reload handlers are expected
+// to be re-runnable: operators send the reload signal repeatedly (e.g. to
+// pick up a changed config file), and each delivery runs every registered
+// handler again.
+type ReloadCallback func() error
+
+// OnReload registers cb to run whenever a reload signal is received. It is
+// a convenience wrapper around OnReloadE for handlers that can't fail; use
+// OnReloadE directly to observe errors from TriggerReload.
+func (t *Trap) OnReload(cb Callback) CallbackRemover {
+	return t.OnReloadE(func() error {
+		cb()
+
+		return nil
+	})
+}
+
+// OnReloadE registers cb to run whenever a reload signal is received, or
+// TriggerReload is called directly. Unlike kill callbacks, reload callbacks
+// are never truncated after running: operators can send the reload signal
+// as many times as they like, and every registered callback runs again in
+// FIFO order (the order they were registered in).
+func (t *Trap) OnReloadE(cb ReloadCallback) CallbackRemover {
+	t.reloadMux.Lock()
+	defer t.reloadMux.Unlock()
+
+	e := t.reloadCbs.PushBack(cb)
+
+	return func() {
+		t.reloadMux.Lock()
+		defer t.reloadMux.Unlock()
+
+		t.reloadCbs.Remove(e)
+	}
+}
+
+// TriggerReload runs every registered reload callback, in the order they
+// were registered (FIFO), and returns the errors of any that failed. It is
+// called automatically when a reload signal (see SetReloadSignals) is
+// received, but can also be invoked directly, e.g. from an admin endpoint.
+func (t *Trap) TriggerReload() []error {
+	t.reloadMux.Lock()
+	defer t.reloadMux.Unlock()
+
+	var errs []error
+
+	for e := t.reloadCbs.Front(); e != nil; e = e.Next() {
+		cb, ok := e.Value.(ReloadCallback)
+
+		if !ok {
+			continue
+		}
+
+		if err := cb(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// SetReloadSignals replaces the set of signals that trigger a reload. By
+// default this is SIGUSR1 and SIGHUP. Signals dropped from the previous set
+// are unsubscribed, not just ignored, so they don't keep the OS relaying
+// them to the trap forever.
+func (t *Trap) SetReloadSignals(sigs ...os.Signal) {
+	t.reloadMux.Lock()
+	defer t.reloadMux.Unlock()
+
+	next := make(map[os.Signal]bool, len(sigs))
+
+	for _, sig := range sigs {
+		next[sig] = true
+	}
+
+	t.reloadSignals = next
+
+	t.resubscribe()
+}
+
+// resubscribe reconciles the OS-level signal.Notify registration for t.ch
+// against every signal the trap currently cares about: the fixed kill
+// signals, the current reload signal set, and every signal with an
+// OnSignal/OnKill-style callback registered. It stops relaying entirely
+// first, since signal.Stop only works for the whole channel, then
+// re-registers the full set, so a signal removed from reloadSignals doesn't
+// stay subscribed. Callers must hold reloadMux.
+func (t *Trap) resubscribe() {
+	signal.Stop(t.ch)
+
+	signal.Notify(t.ch, syscall.SIGKILL, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+
+	for sig := range t.reloadSignals {
+		signal.Notify(t.ch, sig)
+	}
+
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+
+	for sig := range t.cbsList {
+		signal.Notify(t.ch, sig)
+	}
+}
+
+// isReloadSignal reports whether s is currently configured to trigger a reload.
+func (t *Trap) isReloadSignal(s os.Signal) bool {
+	t.reloadMux.RLock()
+	defer t.reloadMux.RUnlock()
+
+	return t.reloadSignals[s]
+}
+
+func OnReload(cb Callback) CallbackRemover        { return Default.OnReload(cb) }
+func OnReloadE(cb ReloadCallback) CallbackRemover { return Default.OnReloadE(cb) }
+func TriggerReload() []error                      { return Default.TriggerReload() }
+func SetReloadSignals(sigs ...os.Signal)          { Default.SetReloadSignals(sigs...) }
@@ -0,0 +1,62 @@
+package trap
+
+import (
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// TestReloadCallbacksRunInFIFOOrder verifies reload callbacks run in
+// registration order, and run again in full on every TriggerReload call.
+func TestReloadCallbacksRunInFIFOOrder(t *testing.T) {
+	tr := New()
+	defer tr.Stop()
+
+	var mu sync.Mutex
+	var order []int
+
+	for i := 0; i < 3; i++ {
+		i := i
+
+		tr.OnReload(func() {
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+		})
+	}
+
+	tr.TriggerReload()
+
+	if !reflect.DeepEqual(order, []int{0, 1, 2}) {
+		t.Fatalf("expected reload callbacks to run FIFO, got %v", order)
+	}
+
+	order = nil
+	tr.TriggerReload()
+
+	if !reflect.DeepEqual(order, []int{0, 1, 2}) {
+		t.Fatalf("expected reload callbacks to run again in FIFO order, got %v", order)
+	}
+}
+
+// TestSetReloadSignalsReplacesSet verifies SetReloadSignals both adds the
+// new signals and drops the old ones from isReloadSignal's view.
+func TestSetReloadSignalsReplacesSet(t *testing.T) {
+	tr := New()
+	defer tr.Stop()
+
+	if !tr.isReloadSignal(syscall.SIGHUP) {
+		t.Fatal("SIGHUP should be a reload signal by default")
+	}
+
+	tr.SetReloadSignals(syscall.SIGUSR2)
+
+	if tr.isReloadSignal(syscall.SIGHUP) {
+		t.Fatal("SIGHUP should no longer be a reload signal after SetReloadSignals dropped it")
+	}
+
+	if !tr.isReloadSignal(syscall.SIGUSR2) {
+		t.Fatal("SIGUSR2 should be a reload signal after SetReloadSignals added it")
+	}
+}
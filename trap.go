@@ -5,148 +5,383 @@ package trap
 
 import (
 	"container/list"
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
 	"runtime/debug"
 	"sync"
 	"syscall"
+	"time"
 )
 
 type Callback func()
+type ContextCallback func(ctx context.Context)
 type CallbackRemover func()
 
-var (
-	wait    sync.WaitGroup
-	mux     sync.RWMutex
-	cbsList map[os.Signal]*list.List
-	ch      chan os.Signal
-)
+// callbackEntry wraps a registered callback so it can be run with a
+// (possibly deadline-bound) context, regardless of whether it was
+// registered through the plain Callback or the ContextCallback API.
+type callbackEntry struct {
+	run     ContextCallback
+	base    context.Context
+	timeout time.Duration
+}
+
+// Trap owns a single signal channel, its callback registrations, and the
+// goroutine that dispatches them. Most applications only need the package
+// level wrappers, which operate on Default, but New lets a test (or an
+// application embedding multiple independent lifecycles) create its own,
+// disposable trap.
+type Trap struct {
+	wait            sync.WaitGroup
+	killWait        sync.WaitGroup
+	mux             sync.RWMutex
+	cbsList         map[os.Signal]*list.List
+	ch              chan os.Signal
+	shutdownTimeout time.Duration
+
+	reloadMux     sync.RWMutex
+	reloadCbs     *list.List
+	reloadSignals map[os.Signal]bool
+
+	killMux     sync.Mutex
+	killBuckets map[int]*list.List
+
+	errMux        sync.Mutex
+	errorHandler  ErrorHandler
+	pendingErrors []error
+
+	shutdownMux      sync.Mutex
+	shuttingDown     bool
+	forceExitEnabled bool
+	forceExitCode    int
+}
+
+// Default is the package-level Trap backing the top-level functions, kept
+// for backward compatibility with code written before New existed.
+var Default = New()
+
+// New creates a Trap and starts its signal listener goroutine. Call Stop
+// when it's no longer needed to release the listener goroutine.
+func New() *Trap {
+	t := &Trap{
+		cbsList:       make(map[os.Signal]*list.List),
+		ch:            make(chan os.Signal, 3),
+		reloadCbs:     list.New(),
+		reloadSignals: map[os.Signal]bool{syscall.SIGUSR1: true, syscall.SIGHUP: true},
+		killBuckets:   map[int]*list.List{},
+		errorHandler:  defaultErrorHandler,
+	}
+
+	for s := range t.reloadSignals {
+		signal.Notify(t.ch, s)
+	}
 
-// init initializes the callback list(s) and starts the signal listener
-func init() {
-	cbsList = make(map[os.Signal]*list.List)
-	ch = make(chan os.Signal, 3)
+	signal.Notify(t.ch, syscall.SIGKILL, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
 
-	wait.Add(1)
+	t.wait.Add(1)
 
 	go func() {
-		defer wait.Done()
+		defer t.wait.Done()
 
 		var s os.Signal
 		var ok bool
 
 		for true {
 			// When the channel is closed, trap instance should exit
-			if s, ok = <-ch; !ok {
+			if s, ok = <-t.ch; !ok {
 				break
 			}
 
-			processSignal(s)
+			// Kill signals are dispatched onto their own goroutine so this
+			// loop keeps draining ch while the (potentially slow) kill
+			// callbacks run, which is what lets a second kill signal reach
+			// handleKillSignal in time to force-exit.
+			if isKillSignal(s) {
+				t.handleKillSignal(s)
+
+				continue
+			}
+
+			if t.isReloadSignal(s) {
+				for _, err := range t.TriggerReload() {
+					t.handleError(s, err, nil)
+				}
+			}
+
+			t.processSignal(s)
 		}
 	}()
+
+	return t
+}
+
+// SetShutdownTimeout sets the deadline given to every callback that isn't
+// registered with its own timeout (e.g. through OnSignalWithTimeout). A
+// zero duration, the default, means callbacks are given no deadline at all.
+func (t *Trap) SetShutdownTimeout(d time.Duration) {
+	t.shutdownMux.Lock()
+	defer t.shutdownMux.Unlock()
+
+	t.shutdownTimeout = d
+}
+
+// getShutdownTimeout returns the deadline set through SetShutdownTimeout.
+// It's read under t.shutdownMux since it can be set concurrently with an
+// in-flight shutdown, from runCallback and runKillPhase. It can't use t.mux:
+// processSignal holds that lock while it calls runCallback.
+func (t *Trap) getShutdownTimeout() time.Duration {
+	t.shutdownMux.Lock()
+	defer t.shutdownMux.Unlock()
+
+	return t.shutdownTimeout
 }
 
 // processSignal will execute all callbacks for the given signal
 // To ensure the 'kill callbacks' are not triggered twice,
 // the list of these callbacks will be truncated
-func processSignal(s os.Signal) {
-	mux.Lock()
-	defer mux.Unlock()
+func (t *Trap) processSignal(s os.Signal) {
+	if isKillSignal(s) {
+		// Kill callbacks are no longer kept in cbsList; they run through
+		// the phase-ordered bucket system, see kill.go.
+		t.runKillCallbacks(s)
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
 
 	// Try and select the list, continue otherwise
-	cbs, ok := cbsList[s]
+	cbs, ok := t.cbsList[s]
 
 	if !ok {
 		return
 	}
 
-	switch s {
-	case syscall.SIGKILL, syscall.SIGINT, syscall.SIGQUIT:
+	if isKillSignal(s) {
 		// Ensure quit callbacks are only run once!
-		cbsList[syscall.SIGKILL] = list.New()
-		cbsList[syscall.SIGINT] = list.New()
-		cbsList[syscall.SIGQUIT] = list.New()
+		t.cbsList[syscall.SIGKILL] = list.New()
+		t.cbsList[syscall.SIGINT] = list.New()
+		t.cbsList[syscall.SIGQUIT] = list.New()
+		t.cbsList[syscall.SIGTERM] = list.New()
 	}
 
 	// Execute from back to front, so the order is FILO
 	for e := cbs.Back(); e != nil; e = e.Prev() {
-		if cb, cbok := e.Value.(Callback); cbok {
-			cb()
+		if entry, cbok := e.Value.(callbackEntry); cbok {
+			t.runCallback(s, entry)
 		} else {
 			// This should never happen,
 			// but handled here anyway so it does not error silently
-			fmt.Printf("trap error: list item not a callback")
+			t.handleError(s, errors.New("trap: list item not a callback"), nil)
 		}
 	}
 }
 
+// runCallback executes a single callback on its own goroutine and waits for
+// it to finish, up to whichever deadline applies (the callback's own
+// timeout, falling back to the global shutdown timeout). A callback that
+// does not finish in time is logged and abandoned, so a single slow
+// callback can't block the remaining ones indefinitely.
+func (t *Trap) runCallback(s os.Signal, entry callbackEntry) {
+	deadline := entry.timeout
+
+	if deadline <= 0 {
+		deadline = t.getShutdownTimeout()
+	}
+
+	base := entry.base
+
+	if base == nil {
+		base = context.Background()
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+
+	if deadline > 0 {
+		ctx, cancel = context.WithTimeout(base, deadline)
+	} else {
+		ctx, cancel = context.WithCancel(base)
+	}
+
+	defer cancel()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		defer func() {
+			if r := recover(); r != nil {
+				t.handleError(s, fmt.Errorf("panic in callback: %v", r), debug.Stack())
+			}
+		}()
+
+		entry.run(ctx)
+	}()
+
+	if deadline <= 0 {
+		<-done
+
+		return
+	}
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		t.handleError(s, fmt.Errorf("callback timed out after %s", deadline), nil)
+	}
+}
+
 // Deferrer should be called when the (main) go routing terminates,
 // as part of the deferred functions, for signal termination, normal termination AND panics.
 // This will ensure any caught signals won't be written to a closed channel.
-func Deferrer() {
+// It returns the errors accumulated since the last call (panicking
+// callbacks, callbacks that missed their deadline, etc.) as a MultiError,
+// or nil if there were none.
+func (t *Trap) Deferrer() *MultiError {
 	if err := recover(); err != nil {
-		fmt.Printf("Panic received, attempting gracefull exit\nError:\n%s", err)
-
-		debug.PrintStack()
+		t.handleError(syscall.SIGINT, fmt.Errorf("panic received, attempting graceful exit: %v", err), debug.Stack())
 
 		defer os.Exit(1)
 	}
 
-	signal.Stop(ch)
+	signal.Stop(t.ch)
 
 	// Send an interrupt signal to the channel to ensure all kill callbacks are triggered,
 	// even on panic or normal termination
-	ch <- syscall.SIGINT
+	t.ch <- syscall.SIGINT
+
+	close(t.ch)
+
+	t.wait.Wait()
+	t.killWait.Wait()
 
-	close(ch)
+	t.errMux.Lock()
+	errs := t.pendingErrors
+	t.pendingErrors = nil
+	t.errMux.Unlock()
 
-	wait.Wait()
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return &MultiError{Errors: errs}
 }
 
-// OnReload will process the callback on receiving a SIGUSR1 signal
-func OnReload(cb Callback) CallbackRemover {
-	return OnSignal(syscall.SIGUSR1, cb)
+// Stop releases the resources started by New: it stops relaying OS signals,
+// closes the signal channel and waits for the listener goroutine to exit.
+// Unlike Deferrer, it does not run kill callbacks first, making it suitable
+// for disposing of a Trap created in a test.
+func (t *Trap) Stop() {
+	signal.Stop(t.ch)
+
+	close(t.ch)
+
+	t.wait.Wait()
+	t.killWait.Wait()
 }
 
-// OnKill will process the callback on receiving a SIGKILL, SIGQUIT or SIGINT signal
-// A normal, or panic termination will result in a SIGINT, therefor triggering these callbacks
-func OnKill(cb Callback) CallbackRemover {
-	var rfns []func()
+// NotifyContext mirrors os/signal.NotifyContext: it returns a context that
+// is cancelled as soon as the trap receives one of the given signals, and a
+// CancelFunc that stops that relaying and releases resources. Unlike
+// os/signal.NotifyContext, the relaying goes through the trap's own signal
+// plumbing, so it composes with any other OnSignal/OnKill/OnReload
+// registrations for the same signals.
+func (t *Trap) NotifyContext(parent context.Context, sigs ...os.Signal) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
 
-	rfns = append(rfns, OnSignal(syscall.SIGKILL, cb))
-	rfns = append(rfns, OnSignal(syscall.SIGQUIT, cb))
-	rfns = append(rfns, OnSignal(syscall.SIGINT, cb))
+	removers := make([]CallbackRemover, 0, len(sigs))
 
-	return func() {
-		for _, dfn := range rfns {
-			dfn()
+	for _, sig := range sigs {
+		removers = append(removers, t.OnSignal(sig, func() { cancel() }))
+	}
+
+	stop := func() {
+		for _, remove := range removers {
+			remove()
 		}
+
+		cancel()
 	}
+
+	return ctx, stop
 }
 
 // OnSignal is used internally to register the callbacks for some predefined signals
 // This can however also be used in the consuming package or application to register any other signal callbacks
-func OnSignal(sig os.Signal, cb Callback) CallbackRemover {
-	mux.Lock()
-	defer mux.Unlock()
+func (t *Trap) OnSignal(sig os.Signal, cb Callback) CallbackRemover {
+	return t.register(sig, callbackEntry{
+		run: func(ctx context.Context) { cb() },
+	})
+}
+
+// OnSignalContext behaves like OnSignal, but cb receives a context.Context
+// derived from ctx that is cancelled once the global shutdown timeout elapses.
+func (t *Trap) OnSignalContext(sig os.Signal, ctx context.Context, cb ContextCallback) CallbackRemover {
+	return t.register(sig, callbackEntry{
+		run:  cb,
+		base: ctx,
+	})
+}
+
+// OnSignalWithTimeout behaves like OnSignal, but cb receives a
+// context.Context that is cancelled once timeout elapses, regardless of the
+// global shutdown timeout set through SetShutdownTimeout.
+func (t *Trap) OnSignalWithTimeout(sig os.Signal, timeout time.Duration, cb ContextCallback) CallbackRemover {
+	return t.register(sig, callbackEntry{
+		run:     cb,
+		timeout: timeout,
+	})
+}
+
+// register stores a callback entry for the given signal, wiring up
+// signal.Notify the first time that signal is seen.
+func (t *Trap) register(sig os.Signal, entry callbackEntry) CallbackRemover {
+	t.mux.Lock()
+	defer t.mux.Unlock()
 
-	l, ok := cbsList[sig]
+	l, ok := t.cbsList[sig]
 
 	if !ok {
-		signal.Notify(ch, sig)
+		signal.Notify(t.ch, sig)
 
 		l = list.New()
 
-		cbsList[sig] = l
+		t.cbsList[sig] = l
 	}
 
-	e := l.PushBack(cb)
+	e := l.PushBack(entry)
 
 	return func() {
-		mux.Lock()
-		defer mux.Unlock()
+		t.mux.Lock()
+		defer t.mux.Unlock()
 
 		l.Remove(e)
 	}
 }
+
+// The functions below are thin wrappers around Default, kept so existing
+// callers of the package-level API keep working unchanged.
+
+func SetShutdownTimeout(d time.Duration) { Default.SetShutdownTimeout(d) }
+
+func Deferrer() *MultiError { return Default.Deferrer() }
+
+func NotifyContext(parent context.Context, sigs ...os.Signal) (context.Context, context.CancelFunc) {
+	return Default.NotifyContext(parent, sigs...)
+}
+
+func OnSignal(sig os.Signal, cb Callback) CallbackRemover {
+	return Default.OnSignal(sig, cb)
+}
+
+func OnSignalContext(sig os.Signal, ctx context.Context, cb ContextCallback) CallbackRemover {
+	return Default.OnSignalContext(sig, ctx, cb)
+}
+
+func OnSignalWithTimeout(sig os.Signal, timeout time.Duration, cb ContextCallback) CallbackRemover {
+	return Default.OnSignalWithTimeout(sig, timeout, cb)
+}
@@ -0,0 +1,47 @@
+package trap
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+// TestTwoInstancesAreIsolated verifies that independent Traps created
+// through New don't share callback registrations or shutdown state: tearing
+// one down must not affect the other.
+func TestTwoInstancesAreIsolated(t *testing.T) {
+	a := New()
+	b := New()
+	defer b.Stop()
+
+	var aRan, bRan int32
+
+	a.OnKill(func() { atomic.StoreInt32(&aRan, 1) })
+	b.OnKill(func() { atomic.StoreInt32(&bRan, 1) })
+
+	a.Deferrer()
+
+	if atomic.LoadInt32(&aRan) != 1 {
+		t.Fatal("trap a's kill callback did not run on its own Deferrer")
+	}
+
+	if atomic.LoadInt32(&bRan) != 0 {
+		t.Fatal("trap b's kill callback ran even though only a was torn down")
+	}
+}
+
+// TestStopDoesNotRunKillCallbacks verifies Stop's documented difference from
+// Deferrer: it disposes of the Trap without running kill callbacks, so a
+// test can create and dispose of a Trap without triggering shutdown logic.
+func TestStopDoesNotRunKillCallbacks(t *testing.T) {
+	tr := New()
+
+	var ran int32
+
+	tr.OnKill(func() { atomic.StoreInt32(&ran, 1) })
+
+	tr.Stop()
+
+	if atomic.LoadInt32(&ran) != 0 {
+		t.Fatal("Stop should not trigger kill callbacks")
+	}
+}